@@ -30,12 +30,20 @@ package main
  */
 import (
 	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"strconv"
 	"time"
 
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	"github.com/hyperledger/fabric/protos/msp"
 	sc "github.com/hyperledger/fabric/protos/peer"
 )
 
@@ -43,17 +51,287 @@ import (
 type SmartContract struct {
 }
 
-// Define the StudentDoc structure, with 3 properties.  Structure tags are used by encoding/json library
+// Define the StudentDoc structure, with 7 properties.  Structure tags are used by encoding/json library
+// DocType lets a studentDoc be distinguished from other asset types that may
+// share the same ledger/CouchDB state database, which CouchDB selectors rely on.
+// ContentHash/PrevHash form an in-asset audit chain: ContentHash is the SHA-256 hex
+// digest of the contentHex string supplied to createStudentDocWithHash (later updates
+// carry it over unchanged), and PrevHash is the ContentHash of the record this one
+// replaced, so tampering with history can be detected independently of Fabric's own
+// block hashes.
+// LastModifiedBy records the MSP ID and certificate CN of whoever last wrote the
+// record, taken from the transaction creator rather than a trusted argument. The
+// records seeded by initLedger leave it empty.
+// PrivateDataHash is the SHA-256 hex digest of the studentDocPrivate payload for this
+// id, if any, kept on the public asset so auditors can verify the private data
+// without ever seeing the underlying PII.
 type StudentDoc struct {
-	DocStatus  string `json:"docStatus"`
-	Owner string `json:"owner"`
+	DocType         string `json:"docType"`
+	DocStatus       string `json:"docStatus"`
+	Owner           string `json:"owner"`
+	ContentHash     string `json:"contentHash"`
+	PrevHash        string `json:"prevHash"`
+	LastModifiedBy  string `json:"lastModifiedBy"`
+	PrivateDataHash string `json:"privateDataHash,omitempty"`
+}
+
+// studentDocPrivateCollection is the private data collection that holds the PII
+// portion of a studentDoc (student identifiers, scores). Its membership/policy is
+// configured in the collections config deployed alongside this chaincode.
+const studentDocPrivateCollection = "studentDocPrivate"
+
+// moderationConfigKey is a reserved ledger key (outside the StudentDocN keyspace)
+// that holds the moderation hook's configuration, set once at instantiate time.
+const moderationConfigKey = "~moderationConfig"
+
+// ModerationConfig controls the optional content-moderation hook. It is stored on
+// the ledger rather than hardcoded so the endpoint can be rotated without a
+// chaincode upgrade.
+//
+// IMPORTANT non-determinism warning: endorsing peers execute Invoke independently
+// and must all arrive at the same read/write set, or the transaction will fail
+// endorsement policy validation at commit time. For that reason the chaincode never
+// calls Endpoint itself: the client runs moderation once off-chain and passes the
+// verdict through APIstub.GetTransient(), so every endorser reads the identical
+// cached value (see checkModeration).
+type ModerationConfig struct {
+	Enabled  bool   `json:"enabled"`
+	Endpoint string `json:"endpoint"`
+}
+
+// moderationVerdict is the shape expected back from the moderation endpoint.
+type moderationVerdict struct {
+	Rejected bool   `json:"rejected"`
+	Reason   string `json:"reason"`
+}
+
+// ownerIndex and statusIndex name the composite-key secondary indices maintained
+// alongside every studentDoc so owner/status lookups can use
+// GetStateByPartialCompositeKey instead of a full range scan.
+const ownerIndex = "owner~id"
+const statusIndex = "status~id"
+
+// docEvent is the JSON payload emitted with every studentDoc lifecycle event.
+type docEvent struct {
+	Id        string `json:"id"`
+	Old       string `json:"old"`
+	New       string `json:"new"`
+	TxCreator string `json:"txCreator"`
+}
+
+// emitDocEvent sets a chaincode event of the given name carrying the id, old/new
+// values and the transaction creator, for downstream applications to subscribe to.
+func emitDocEvent(APIstub shim.ChaincodeStubInterface, name string, id string, oldValue string, newValue string) error {
+
+	creator, err := callerIdentity(APIstub)
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(docEvent{Id: id, Old: oldValue, New: newValue, TxCreator: creator})
+	if err != nil {
+		return err
+	}
+
+	return APIstub.SetEvent(name, payload)
+}
+
+// putIndexEntry replaces a composite-key secondary index entry, deleting the old
+// key (if attrValue actually changed) before putting the new one so the index never
+// has two entries pointing at the same id.
+func putIndexEntry(APIstub shim.ChaincodeStubInterface, indexName string, oldAttrValue string, newAttrValue string, id string) error {
+
+	if oldAttrValue != "" && oldAttrValue != newAttrValue {
+		oldKey, err := APIstub.CreateCompositeKey(indexName, []string{oldAttrValue, id})
+		if err != nil {
+			return err
+		}
+		if err := APIstub.DelState(oldKey); err != nil {
+			return err
+		}
+	}
+
+	newKey, err := APIstub.CreateCompositeKey(indexName, []string{newAttrValue, id})
+	if err != nil {
+		return err
+	}
+	return APIstub.PutState(newKey, []byte{0x00})
+}
+
+// checkModeration enforces the content-moderation hook, if enabled. It does not call
+// the endpoint: it reads the verdict cached in the transient map under
+// "moderationVerdict" (set by a client that already ran the check off-chain), fails
+// when none was supplied, and fails when the verdict is a rejection. The status and
+// owner strings are not sent anywhere and are not compared against the verdict.
+func checkModeration(APIstub shim.ChaincodeStubInterface, status string, owner string) error {
+
+	configAsBytes, err := APIstub.GetState(moderationConfigKey)
+	if err != nil {
+		return err
+	}
+	if configAsBytes == nil {
+		return nil
+	}
+
+	config := ModerationConfig{}
+	json.Unmarshal(configAsBytes, &config)
+	if !config.Enabled {
+		return nil
+	}
+
+	// Moderation must never be called live from inside Invoke: endorsing peers run
+	// independently, so an in-transaction http.Post could return a different verdict
+	// (or hang) per peer and break endorsement. The client is required to run the
+	// check against config.Endpoint off-chain first and pass the resulting verdict
+	// through the transient map, so every endorser reads the identical cached value.
+	transientMap, _ := APIstub.GetTransient()
+	cached, ok := transientMap["moderationVerdict"]
+	if !ok {
+		return fmt.Errorf("moderation is enabled but no moderationVerdict was supplied via transient data")
+	}
+
+	verdict := moderationVerdict{}
+	if err := json.Unmarshal(cached, &verdict); err != nil {
+		return err
+	}
+	if verdict.Rejected {
+		return fmt.Errorf("rejected by content moderation: %s", verdict.Reason)
+	}
+
+	return nil
+}
+
+// hashContentHex returns the hex-encoded SHA-256 digest of contentHex, the
+// hex-encoded content supplied by the caller.
+func hashContentHex(contentHex string) string {
+	sum := sha256.Sum256([]byte(contentHex))
+	return hex.EncodeToString(sum[:])
+}
+
+// statusTransitions is the configurable state machine of status changes each role is
+// permitted to make. It maps a role attribute value to the set of previous statuses
+// it may act on, and for each of those, the statuses it may transition the doc to.
+// The empty previous status represents doc creation.
+var statusTransitions = map[string]map[string][]string{
+	"scanner": {
+		"": {"scanned"},
+	},
+	"transmitter": {
+		"scanned":         {"transmitted responses"},
+		"scores exported": {"transmitted scores"},
+	},
+	"receiver": {
+		"transmitted responses": {"received responses"},
+		"transmitted scores":    {"received scores"},
+	},
+	"scorer": {
+		"received responses": {"machine scored", "human scored"},
+		"machine scored":     {"human scored", "scores exported"},
+		"human scored":       {"scores exported"},
+	},
+	"reporter": {
+		"received scores": {"scores reported"},
+	},
+}
+
+// authorizeStatusTransition checks that the caller's "role" client identity attribute
+// permits moving a studentDoc from previousStatus to newStatus, returning an error the
+// caller can turn into a shim.Error if not.
+func authorizeStatusTransition(APIstub shim.ChaincodeStubInterface, previousStatus string, newStatus string) error {
+
+	role, found, err := cid.GetAttributeValue(APIstub, "role")
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("caller identity does not carry a role attribute")
+	}
+
+	allowedTargets, ok := statusTransitions[role][previousStatus]
+	if !ok {
+		return fmt.Errorf("role %s may not act on documents in status %q", role, previousStatus)
+	}
+
+	for _, allowed := range allowedTargets {
+		if allowed == newStatus {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("role %s may not move a document from %q to %q", role, previousStatus, newStatus)
+}
+
+// authorizeOwnerChange checks that the caller's "role" client identity attribute is
+// one of the roles permitted to act on a studentDoc while it sits in currentStatus,
+// reusing the same statusTransitions table authorizeStatusTransition consults, so
+// reassigning a doc's owner requires the same standing as moving its status would.
+func authorizeOwnerChange(APIstub shim.ChaincodeStubInterface, currentStatus string) error {
+
+	role, found, err := cid.GetAttributeValue(APIstub, "role")
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("caller identity does not carry a role attribute")
+	}
+
+	if _, ok := statusTransitions[role][currentStatus]; !ok {
+		return fmt.Errorf("role %s may not reassign a document in status %q", role, currentStatus)
+	}
+
+	return nil
+}
+
+// callerIdentity returns the MSP ID and certificate common name of the transaction
+// creator, read from APIstub.GetCreator() rather than trusted as an argument.
+func callerIdentity(APIstub shim.ChaincodeStubInterface) (string, error) {
+
+	creatorBytes, err := APIstub.GetCreator()
+	if err != nil {
+		return "", err
+	}
+
+	sId := &msp.SerializedIdentity{}
+	if err := proto.Unmarshal(creatorBytes, sId); err != nil {
+		return "", fmt.Errorf("failed to unmarshal creator identity: %s", err)
+	}
+
+	block, _ := pem.Decode(sId.IdBytes)
+	if block == nil {
+		return "", fmt.Errorf("failed to decode PEM block from creator identity")
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse creator certificate: %s", err)
+	}
+
+	return sId.Mspid + "::" + cert.Subject.CommonName, nil
 }
 
 /*
  * The Init method is called when the Smart Contract "docledger" is instantiated by the blockchain network
  * Best practice is to have any Ledger initialization in separate function -- see initLedger()
+ *
+ * Accepts two optional args, moderationEnabled ("true"/"false") and moderationEndpoint,
+ * which configure the content-moderation hook (see checkModeration) used by
+ * createStudentDoc and changeStudentDocStatus. With no args moderation stays disabled.
  */
 func (s *SmartContract) Init(APIstub shim.ChaincodeStubInterface) sc.Response {
+
+	_, args := APIstub.GetFunctionAndParameters()
+
+	config := ModerationConfig{}
+	if len(args) > 0 {
+		config.Enabled = args[0] == "true"
+	}
+	if len(args) > 1 {
+		config.Endpoint = args[1]
+	}
+
+	configAsBytes, _ := json.Marshal(config)
+	APIstub.PutState(moderationConfigKey, configAsBytes)
+
 	return shim.Success(nil)
 }
 
@@ -80,6 +358,26 @@ func (s *SmartContract) Invoke(APIstub shim.ChaincodeStubInterface) sc.Response
 		return s.changeStudentDocStatus(APIstub, args)
 	} else if function == "getHistoryForStudentDoc" {
 		return s.getHistoryForStudentDoc(APIstub, args)
+	} else if function == "queryStudentDocsByOwner" {
+		return s.queryStudentDocsByOwner(APIstub, args)
+	} else if function == "queryStudentDocsByStatus" {
+		return s.queryStudentDocsByStatus(APIstub, args)
+	} else if function == "queryStudentDocsByCouchQuery" {
+		return s.queryStudentDocsByCouchQuery(APIstub, args)
+	} else if function == "createStudentDocWithHash" {
+		return s.createStudentDocWithHash(APIstub, args)
+	} else if function == "verifyStudentDoc" {
+		return s.verifyStudentDoc(APIstub, args)
+	} else if function == "verifyStudentDocHistory" {
+		return s.verifyStudentDocHistory(APIstub, args)
+	} else if function == "createStudentDocPrivate" {
+		return s.createStudentDocPrivate(APIstub, args)
+	} else if function == "readStudentDocPrivate" {
+		return s.readStudentDocPrivate(APIstub, args)
+	} else if function == "verifyStudentDocPrivateHash" {
+		return s.verifyStudentDocPrivateHash(APIstub, args)
+	} else if function == "queryStudentDocsByOwnerFast" {
+		return s.queryStudentDocsByOwnerFast(APIstub, args)
 	}
 
 	return shim.Error(function + ": Invalid Smart Contract function name.")
@@ -97,22 +395,31 @@ func (s *SmartContract) queryStudentDoc(APIstub shim.ChaincodeStubInterface, arg
 
 func (s *SmartContract) initLedger(APIstub shim.ChaincodeStubInterface) sc.Response {
 	studentDocs := []StudentDoc{
-		StudentDoc{DocStatus: "scanned", Owner: "Tomoko"},
-		StudentDoc{DocStatus: "transmitted responses", Owner: "Jack"},
-		StudentDoc{DocStatus: "received responses", Owner: "John"},
-		StudentDoc{DocStatus: "machine scored", Owner: "Mark"},
-		StudentDoc{DocStatus: "human scored", Owner: "Tim"},
-		StudentDoc{DocStatus: "scores exported", Owner: "Jane"},
-		StudentDoc{DocStatus: "transmitted scores", Owner: "Peter"},
-		StudentDoc{DocStatus: "received scores", Owner: "Sid"},
-		StudentDoc{DocStatus: "scores reported", Owner: "Mesut"},
+		StudentDoc{DocType: "studentDoc", DocStatus: "scanned", Owner: "Tomoko"},
+		StudentDoc{DocType: "studentDoc", DocStatus: "transmitted responses", Owner: "Jack"},
+		StudentDoc{DocType: "studentDoc", DocStatus: "received responses", Owner: "John"},
+		StudentDoc{DocType: "studentDoc", DocStatus: "machine scored", Owner: "Mark"},
+		StudentDoc{DocType: "studentDoc", DocStatus: "human scored", Owner: "Tim"},
+		StudentDoc{DocType: "studentDoc", DocStatus: "scores exported", Owner: "Jane"},
+		StudentDoc{DocType: "studentDoc", DocStatus: "transmitted scores", Owner: "Peter"},
+		StudentDoc{DocType: "studentDoc", DocStatus: "received scores", Owner: "Sid"},
+		StudentDoc{DocType: "studentDoc", DocStatus: "scores reported", Owner: "Mesut"},
 	}
 
 	i := 0
 	for i < len(studentDocs) {
 		fmt.Println("i is ", i)
+		id := "StudentDoc" + strconv.Itoa(i)
 		studentDocAsBytes, _ := json.Marshal(studentDocs[i])
-		APIstub.PutState("StudentDoc"+strconv.Itoa(i), studentDocAsBytes)
+		APIstub.PutState(id, studentDocAsBytes)
+
+		if err := putIndexEntry(APIstub, ownerIndex, "", studentDocs[i].Owner, id); err != nil {
+			return shim.Error(err.Error())
+		}
+		if err := putIndexEntry(APIstub, statusIndex, "", studentDocs[i].DocStatus, id); err != nil {
+			return shim.Error(err.Error())
+		}
+
 		fmt.Println("Added", studentDocs[i])
 		i = i + 1
 	}
@@ -126,14 +433,283 @@ func (s *SmartContract) createStudentDoc(APIstub shim.ChaincodeStubInterface, ar
 		return shim.Error("Incorrect number of arguments. Expecting 3")
 	}
 
-	var studentDoc = StudentDoc{DocStatus: args[1], Owner: args[2]}
+	if err := authorizeStatusTransition(APIstub, "", args[1]); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if err := checkModeration(APIstub, args[1], args[2]); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	lastModifiedBy, err := callerIdentity(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var studentDoc = StudentDoc{DocType: "studentDoc", DocStatus: args[1], Owner: args[2], LastModifiedBy: lastModifiedBy}
 
 	studentDocAsBytes, _ := json.Marshal(studentDoc)
 	APIstub.PutState(args[0], studentDocAsBytes)
 
+	if err := putIndexEntry(APIstub, ownerIndex, "", args[2], args[0]); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := putIndexEntry(APIstub, statusIndex, "", args[1], args[0]); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if err := emitDocEvent(APIstub, "StudentDocCreated", args[0], "", args[1]); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// createStudentDocWithHash stores a studentDoc the same way createStudentDoc does, but
+// also records the SHA-256 hex digest of the supplied contentHex string (the hex text
+// itself, not the bytes it encodes) as ContentHash so later calls can verify the
+// document hasn't been tampered with.
+func (s *SmartContract) createStudentDocWithHash(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4")
+	}
+
+	id := args[0]
+	docStatus := args[1]
+	owner := args[2]
+	contentHex := args[3]
+
+	if err := authorizeStatusTransition(APIstub, "", docStatus); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if err := checkModeration(APIstub, docStatus, owner); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	lastModifiedBy, err := callerIdentity(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	studentDoc := StudentDoc{
+		DocType:        "studentDoc",
+		DocStatus:      docStatus,
+		Owner:          owner,
+		ContentHash:    hashContentHex(contentHex),
+		LastModifiedBy: lastModifiedBy,
+	}
+
+	studentDocAsBytes, _ := json.Marshal(studentDoc)
+	APIstub.PutState(id, studentDocAsBytes)
+
+	if err := putIndexEntry(APIstub, ownerIndex, "", owner, id); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := putIndexEntry(APIstub, statusIndex, "", docStatus, id); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if err := emitDocEvent(APIstub, "StudentDocCreated", id, "", docStatus); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// verifyStudentDoc recomputes the SHA-256 hex digest of the supplied contentHex and
+// compares it against the ContentHash recorded on the studentDoc with the given id,
+// returning success only when they match.
+func (s *SmartContract) verifyStudentDoc(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	id := args[0]
+	contentHex := args[1]
+
+	studentDocAsBytes, err := APIstub.GetState(id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if studentDocAsBytes == nil {
+		return shim.Error("studentDoc " + id + " does not exist")
+	}
+
+	studentDoc := StudentDoc{}
+	json.Unmarshal(studentDocAsBytes, &studentDoc)
+
+	if hashContentHex(contentHex) != studentDoc.ContentHash {
+		return shim.Error("content hash mismatch for studentDoc " + id)
+	}
+
+	return shim.Success([]byte("true"))
+}
+
+// verifyStudentDocHistory walks the full ledger history for a studentDoc key and
+// asserts that each record's PrevHash matches the ContentHash of the record before
+// it, returning the TxId of the first broken link found, if any.
+func (s *SmartContract) verifyStudentDocHistory(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	docId := args[0]
+
+	resultsIterator, err := APIstub.GetHistoryForKey(docId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	// GetHistoryForKey returns results newest-to-oldest, but the PrevHash chain was
+	// written oldest-to-newest, so the full history must be collected and walked in
+	// reverse to compare each record against the one that actually preceded it.
+	var history []*queryresult.KeyModification
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if response.IsDelete {
+			continue
+		}
+		history = append(history, response)
+	}
+
+	var prevContentHash string
+	first := true
+
+	for i := len(history) - 1; i >= 0; i-- {
+		response := history[i]
+
+		studentDoc := StudentDoc{}
+		json.Unmarshal(response.Value, &studentDoc)
+
+		if !first && studentDoc.PrevHash != prevContentHash {
+			return shim.Success([]byte("broken at tx " + response.TxId))
+		}
+
+		prevContentHash = studentDoc.ContentHash
+		first = false
+	}
+
+	return shim.Success([]byte("intact"))
+}
+
+// createStudentDocPrivate stores the PII portion of a studentDoc (scores, student
+// identifiers) in the studentDocPrivate collection. The payload is read from the
+// transient map under the "studentDocPrivate" key, not from args, so it never lands
+// in the (gossiped, endorsed-and-ordered) transaction proposal. The public studentDoc
+// record for id, which must already exist, is updated with the SHA-256 hex digest of
+// the private payload so auditors can verify it without ever seeing the PII.
+func (s *SmartContract) createStudentDocPrivate(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	id := args[0]
+
+	if _, found, err := cid.GetAttributeValue(APIstub, "role"); err != nil {
+		return shim.Error(err.Error())
+	} else if !found {
+		return shim.Error("caller identity does not carry a role attribute")
+	}
+
+	transientMap, err := APIstub.GetTransient()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	privateData, ok := transientMap[studentDocPrivateCollection]
+	if !ok {
+		return shim.Error("studentDocPrivate payload not found in transient map")
+	}
+
+	studentDocAsBytes, err := APIstub.GetState(id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if studentDocAsBytes == nil {
+		return shim.Error("public studentDoc " + id + " does not exist")
+	}
+
+	lastModifiedBy, err := callerIdentity(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if err := APIstub.PutPrivateData(studentDocPrivateCollection, id, privateData); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	studentDoc := StudentDoc{}
+	json.Unmarshal(studentDocAsBytes, &studentDoc)
+	studentDoc.PrivateDataHash = hashContentHex(string(privateData))
+	studentDoc.PrevHash = studentDoc.ContentHash
+	studentDoc.LastModifiedBy = lastModifiedBy
+
+	studentDocAsBytes, _ = json.Marshal(studentDoc)
+	APIstub.PutState(id, studentDocAsBytes)
+
 	return shim.Success(nil)
 }
 
+// readStudentDocPrivate returns the raw PII payload for id from the studentDocPrivate
+// collection. Only peers that belong to the collection can satisfy this call.
+func (s *SmartContract) readStudentDocPrivate(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	privateData, err := APIstub.GetPrivateData(studentDocPrivateCollection, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(privateData)
+}
+
+// verifyStudentDocPrivateHash recomputes the SHA-256 hex digest of the private payload
+// for id and compares it against PrivateDataHash on the public studentDoc record,
+// returning only "true" or an error, never the PII itself. It reads the payload with
+// GetPrivateData, so only peers that belong to the collection can satisfy this call.
+func (s *SmartContract) verifyStudentDocPrivateHash(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	id := args[0]
+
+	privateData, err := APIstub.GetPrivateData(studentDocPrivateCollection, id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if privateData == nil {
+		return shim.Error("studentDocPrivate " + id + " does not exist")
+	}
+
+	studentDocAsBytes, err := APIstub.GetState(id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	studentDoc := StudentDoc{}
+	json.Unmarshal(studentDocAsBytes, &studentDoc)
+
+	if hashContentHex(string(privateData)) != studentDoc.PrivateDataHash {
+		return shim.Error("private data hash mismatch for studentDoc " + id)
+	}
+
+	return shim.Success([]byte("true"))
+}
+
 func (s *SmartContract) queryAllStudentDocs(APIstub shim.ChaincodeStubInterface) sc.Response {
 
 	startKey := "StudentDoc0"
@@ -177,21 +753,268 @@ func (s *SmartContract) queryAllStudentDocs(APIstub shim.ChaincodeStubInterface)
 	return shim.Success(buffer.Bytes())
 }
 
+// queryStudentDocsByOwner expects a single argument, the owner to filter on, and
+// returns every studentDoc CouchDB document with a matching owner field.
+func (s *SmartContract) queryStudentDocsByOwner(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	owner := args[0]
+
+	queryStringAsBytes, err := json.Marshal(map[string]interface{}{
+		"selector": map[string]string{"docType": "studentDoc", "owner": owner},
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	queryResults, err := getQueryResultForQueryString(APIstub, string(queryStringAsBytes))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(queryResults)
+}
+
+// queryStudentDocsByStatus expects a single argument, the docStatus to filter on, and
+// returns every studentDoc CouchDB document with a matching docStatus field.
+func (s *SmartContract) queryStudentDocsByStatus(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	docStatus := args[0]
+
+	queryStringAsBytes, err := json.Marshal(map[string]interface{}{
+		"selector": map[string]string{"docType": "studentDoc", "docStatus": docStatus},
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	queryResults, err := getQueryResultForQueryString(APIstub, string(queryStringAsBytes))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(queryResults)
+}
+
+// queryStudentDocsByCouchQuery expects a raw CouchDB selector plus a page size and a
+// bookmark (the empty string requests the first page) and returns one page of matches
+// together with the bookmark CouchDB issued, so a client can request the next page.
+func (s *SmartContract) queryStudentDocsByCouchQuery(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3: selector, pageSize, bookmark")
+	}
+
+	selector := args[0]
+
+	queryStringAsBytes, err := json.Marshal(map[string]interface{}{
+		"selector": json.RawMessage(selector),
+	})
+	if err != nil {
+		return shim.Error("selector must be valid JSON")
+	}
+
+	pageSize, err := strconv.ParseInt(args[1], 10, 32)
+	if err != nil {
+		return shim.Error("pageSize must be an integer")
+	}
+
+	bookmark := args[2]
+
+	resultsIterator, responseMetadata, err := APIstub.GetQueryResultWithPagination(string(queryStringAsBytes), int32(pageSize), bookmark)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	buffer, err := constructQueryResponseFromIterator(resultsIterator)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	queryResults, err := addPaginationMetadataToQueryResults(buffer, responseMetadata)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(queryResults.Bytes())
+}
+
+// getQueryResultForQueryString executes a CouchDB rich query and returns the matching
+// documents as a JSON array. Only usable against a CouchDB state database.
+func getQueryResultForQueryString(APIstub shim.ChaincodeStubInterface, queryString string) ([]byte, error) {
+
+	resultsIterator, err := APIstub.GetQueryResult(queryString)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	buffer, err := constructQueryResponseFromIterator(resultsIterator)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("- getQueryResultForQueryString queryString:%s\n%s\n", queryString, buffer.String())
+
+	return buffer.Bytes(), nil
+}
+
+// constructQueryResponseFromIterator drains a state query iterator into the
+// "[{Key, Record}, ...]" JSON array shape used throughout this chaincode.
+func constructQueryResponseFromIterator(resultsIterator shim.StateQueryIteratorInterface) (*bytes.Buffer, error) {
+
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
+
+	bArrayMemberAlreadyWritten := false
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		if bArrayMemberAlreadyWritten == true {
+			buffer.WriteString(",")
+		}
+		buffer.WriteString("{\"Key\":")
+		buffer.WriteString("\"")
+		buffer.WriteString(queryResponse.Key)
+		buffer.WriteString("\"")
+
+		buffer.WriteString(", \"Record\":")
+		buffer.WriteString(string(queryResponse.Value))
+		buffer.WriteString("}")
+		bArrayMemberAlreadyWritten = true
+	}
+	buffer.WriteString("]")
+
+	return &buffer, nil
+}
+
+// addPaginationMetadataToQueryResults appends the bookmark CouchDB returned for a
+// paginated query so the caller can request the next page.
+func addPaginationMetadataToQueryResults(buffer *bytes.Buffer, responseMetadata *sc.QueryResponseMetadata) (*bytes.Buffer, error) {
+
+	bookmarkJSON, err := json.Marshal(responseMetadata.Bookmark)
+	if err != nil {
+		return nil, err
+	}
+
+	newBuffer := bytes.Buffer{}
+	newBuffer.WriteString("{\"Results\":")
+	newBuffer.Write(buffer.Bytes())
+	newBuffer.WriteString(", \"ResponseMetadata\":{\"RecordsCount\":")
+	newBuffer.WriteString(strconv.FormatInt(int64(responseMetadata.FetchedRecordsCount), 10))
+	newBuffer.WriteString(", \"Bookmark\":")
+	newBuffer.Write(bookmarkJSON)
+	newBuffer.WriteString("}}")
+
+	return &newBuffer, nil
+}
+
+// queryStudentDocsByOwnerFast expects a single argument, the owner to filter on, and
+// returns every matching studentDoc using the owner~id composite-key index instead
+// of a full range scan.
+func (s *SmartContract) queryStudentDocsByOwnerFast(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	owner := args[0]
+
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey(ownerIndex, []string{owner})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
+
+	bArrayMemberAlreadyWritten := false
+	for resultsIterator.HasNext() {
+		compositeKeyResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		_, keyParts, err := APIstub.SplitCompositeKey(compositeKeyResponse.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		id := keyParts[1]
+
+		studentDocAsBytes, err := APIstub.GetState(id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		if bArrayMemberAlreadyWritten == true {
+			buffer.WriteString(",")
+		}
+		buffer.WriteString("{\"Key\":")
+		buffer.WriteString("\"")
+		buffer.WriteString(id)
+		buffer.WriteString("\"")
+
+		buffer.WriteString(", \"Record\":")
+		buffer.WriteString(string(studentDocAsBytes))
+		buffer.WriteString("}")
+		bArrayMemberAlreadyWritten = true
+	}
+	buffer.WriteString("]")
+
+	return shim.Success(buffer.Bytes())
+}
+
 func (s *SmartContract) changeStudentDocOwner(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
 
 	if len(args) != 2 {
 		return shim.Error("Incorrect number of arguments. Expecting 2")
 	}
 
-	studentDocAsBytes, _ := APIstub.GetState(args[0])
-	studentDoc := StudentDoc{}
+	studentDocAsBytes, err := APIstub.GetState(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if studentDocAsBytes == nil {
+		return shim.Error("studentDoc " + args[0] + " does not exist")
+	}
 
+	studentDoc := StudentDoc{}
 	json.Unmarshal(studentDocAsBytes, &studentDoc)
+
+	if err := authorizeOwnerChange(APIstub, studentDoc.DocStatus); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	lastModifiedBy, err := callerIdentity(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	oldOwner := studentDoc.Owner
 	studentDoc.Owner = args[1]
+	studentDoc.PrevHash = studentDoc.ContentHash
+	studentDoc.LastModifiedBy = lastModifiedBy
 
 	studentDocAsBytes, _ = json.Marshal(studentDoc)
 	APIstub.PutState(args[0], studentDocAsBytes)
 
+	if err := putIndexEntry(APIstub, ownerIndex, oldOwner, args[1], args[0]); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if err := emitDocEvent(APIstub, "OwnerChanged", args[0], oldOwner, args[1]); err != nil {
+		return shim.Error(err.Error())
+	}
+
 	return shim.Success(nil)
 }
 
@@ -201,16 +1024,51 @@ func (s *SmartContract) changeStudentDocStatus(APIstub shim.ChaincodeStubInterfa
 		return shim.Error("Incorrect number of arguments. Expecting 3")
 	}
 
-	studentDocAsBytes, _ := APIstub.GetState(args[0])
-	studentDoc := StudentDoc{}
+	studentDocAsBytes, err := APIstub.GetState(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if studentDocAsBytes == nil {
+		return shim.Error("studentDoc " + args[0] + " does not exist")
+	}
 
+	studentDoc := StudentDoc{}
 	json.Unmarshal(studentDocAsBytes, &studentDoc)
+
+	if err := authorizeStatusTransition(APIstub, studentDoc.DocStatus, args[2]); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if err := checkModeration(APIstub, args[2], args[1]); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	lastModifiedBy, err := callerIdentity(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	oldOwner := studentDoc.Owner
+	oldStatus := studentDoc.DocStatus
 	studentDoc.Owner = args[1]
 	studentDoc.DocStatus = args[2]
+	studentDoc.PrevHash = studentDoc.ContentHash
+	studentDoc.LastModifiedBy = lastModifiedBy
 
 	studentDocAsBytes, _ = json.Marshal(studentDoc)
 	APIstub.PutState(args[0], studentDocAsBytes)
 
+	if err := putIndexEntry(APIstub, statusIndex, oldStatus, args[2], args[0]); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := putIndexEntry(APIstub, ownerIndex, oldOwner, args[1], args[0]); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if err := emitDocEvent(APIstub, "StatusChanged", args[0], oldStatus, args[2]); err != nil {
+		return shim.Error(err.Error())
+	}
+
 	return shim.Success(nil)
 }
 